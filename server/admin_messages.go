@@ -0,0 +1,33 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+)
+
+// RunMessagesCommand implements the admin "messages" subcommand: it prints a
+// user's delivery success rate, computed by QueryUserDeliveryStats, to
+// stdout. It's a thin wrapper intended to be dispatched by the admin
+// CLI/API's subcommand router alongside the other admin subcommands.
+func RunMessagesCommand(ctx context.Context, fbClient *firestore.Client, args []string) error {
+	fs := flag.NewFlagSet("messages", flag.ContinueOnError)
+	uid := fs.String("uid", "", "uid to compute delivery stats for")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *uid == "" {
+		return fmt.Errorf("messages: -uid is required")
+	}
+
+	stats, err := QueryUserDeliveryStats(ctx, fbClient, *uid)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("uid=%s sent=%d delivered=%d failed=%d success_rate=%.2f%%\n",
+		stats.Uid, stats.TotalSent, stats.TotalDelivered, stats.TotalFailed, stats.SuccessRate*100)
+	return nil
+}
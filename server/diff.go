@@ -0,0 +1,125 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/SpencerCornish/msubot-appspot/server/constants"
+)
+
+// ChangeKind categorizes what changed about a tracked section between two
+// polls.
+type ChangeKind string
+
+// The set of changes DiffSections can produce.
+const (
+	SeatsOpened       ChangeKind = "SeatsOpened"
+	SeatsClosed       ChangeKind = "SeatsClosed"
+	InstructorChanged ChangeKind = "InstructorChanged"
+	TimeChanged       ChangeKind = "TimeChanged"
+	LocationChanged   ChangeKind = "LocationChanged"
+	SectionRemoved    ChangeKind = "SectionRemoved"
+	SectionAdded      ChangeKind = "SectionAdded"
+)
+
+// SectionChange is one detected difference between a section's previous and
+// current state.
+type SectionChange struct {
+	Crn        string
+	Kind       ChangeKind
+	Before     constants.Section
+	After      constants.Section
+	SeatsDelta int
+}
+
+// DiffSections compares the previous and current state of a set of sections
+// and returns every change it detects. Sections are matched by CRN;
+// a CRN present in only one of the two slices is reported as
+// SectionAdded/SectionRemoved, and a CRN present in both can produce more
+// than one SectionChange (e.g. a seat opening up in a section that also
+// moved rooms).
+func DiffSections(prev, curr []constants.Section) []SectionChange {
+	prevByCrn := make(map[string]constants.Section, len(prev))
+	for _, s := range prev {
+		prevByCrn[s.Crn] = s
+	}
+	currByCrn := make(map[string]constants.Section, len(curr))
+	for _, s := range curr {
+		currByCrn[s.Crn] = s
+	}
+
+	changes := []SectionChange{}
+
+	for crn, before := range prevByCrn {
+		after, stillPresent := currByCrn[crn]
+		if !stillPresent {
+			changes = append(changes, SectionChange{Crn: crn, Kind: SectionRemoved, Before: before})
+			continue
+		}
+		changes = append(changes, diffSection(before, after)...)
+	}
+
+	for crn, after := range currByCrn {
+		if _, existedBefore := prevByCrn[crn]; !existedBefore {
+			changes = append(changes, SectionChange{Crn: crn, Kind: SectionAdded, After: after})
+		}
+	}
+
+	// prevByCrn/currByCrn are maps, so the order changes were appended in
+	// above is nondeterministic across calls with identical input. Sort so
+	// callers (and table-driven tests) can compare the result directly.
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Crn != changes[j].Crn {
+			return changes[i].Crn < changes[j].Crn
+		}
+		return changes[i].Kind < changes[j].Kind
+	})
+
+	return changes
+}
+
+// diffSection compares a single section's before/after state, assuming both
+// refer to the same CRN.
+func diffSection(before, after constants.Section) []SectionChange {
+	changes := []SectionChange{}
+
+	if delta := seatsDelta(before, after); delta != 0 {
+		kind := SeatsOpened
+		if delta < 0 {
+			kind = SeatsClosed
+		}
+		changes = append(changes, SectionChange{
+			Crn:        before.Crn,
+			Kind:       kind,
+			Before:     before,
+			After:      after,
+			SeatsDelta: delta,
+		})
+	}
+
+	if before.Instructor != after.Instructor {
+		changes = append(changes, SectionChange{Crn: before.Crn, Kind: InstructorChanged, Before: before, After: after})
+	}
+	if before.Time != after.Time {
+		changes = append(changes, SectionChange{Crn: before.Crn, Kind: TimeChanged, Before: before, After: after})
+	}
+	if before.Location != after.Location {
+		changes = append(changes, SectionChange{Crn: before.Crn, Kind: LocationChanged, Before: before, After: after})
+	}
+
+	return changes
+}
+
+// seatsDelta returns after.AvailableSeats - before.AvailableSeats, treating
+// an unparseable count as 0 rather than failing the whole diff.
+func seatsDelta(before, after constants.Section) int {
+	b, err := strconv.Atoi(before.AvailableSeats)
+	if err != nil {
+		b = 0
+	}
+	a, err := strconv.Atoi(after.AvailableSeats)
+	if err != nil {
+		a = 0
+	}
+	return a - b
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/SpencerCornish/msubot-appspot/server/constants"
+)
+
+func TestDiffSections(t *testing.T) {
+	base := constants.Section{Crn: "10001", AvailableSeats: "0", Instructor: "Smith", Time: "10:00-10:50", Location: "Wilson 101"}
+
+	cases := []struct {
+		name string
+		prev []constants.Section
+		curr []constants.Section
+		want []SectionChange
+	}{
+		{
+			name: "no change",
+			prev: []constants.Section{base},
+			curr: []constants.Section{base},
+			want: []SectionChange{},
+		},
+		{
+			name: "seat opened",
+			prev: []constants.Section{base},
+			curr: []constants.Section{func() constants.Section { s := base; s.AvailableSeats = "2"; return s }()},
+			want: []SectionChange{{Crn: "10001", Kind: SeatsOpened, Before: base, After: func() constants.Section { s := base; s.AvailableSeats = "2"; return s }(), SeatsDelta: 2}},
+		},
+		{
+			name: "seat closed",
+			prev: []constants.Section{func() constants.Section { s := base; s.AvailableSeats = "2"; return s }()},
+			curr: []constants.Section{base},
+			want: []SectionChange{{Crn: "10001", Kind: SeatsClosed, Before: func() constants.Section { s := base; s.AvailableSeats = "2"; return s }(), After: base, SeatsDelta: -2}},
+		},
+		{
+			name: "room and instructor change together, sorted by kind",
+			prev: []constants.Section{base},
+			curr: []constants.Section{func() constants.Section {
+				s := base
+				s.Instructor = "Jones"
+				s.Location = "Wilson 202"
+				return s
+			}()},
+			want: []SectionChange{
+				{Crn: "10001", Kind: InstructorChanged, Before: base, After: func() constants.Section {
+					s := base
+					s.Instructor = "Jones"
+					s.Location = "Wilson 202"
+					return s
+				}()},
+				{Crn: "10001", Kind: LocationChanged, Before: base, After: func() constants.Section {
+					s := base
+					s.Instructor = "Jones"
+					s.Location = "Wilson 202"
+					return s
+				}()},
+			},
+		},
+		{
+			name: "section removed",
+			prev: []constants.Section{base},
+			curr: []constants.Section{},
+			want: []SectionChange{{Crn: "10001", Kind: SectionRemoved, Before: base}},
+		},
+		{
+			name: "section added",
+			prev: []constants.Section{},
+			curr: []constants.Section{base},
+			want: []SectionChange{{Crn: "10001", Kind: SectionAdded, After: base}},
+		},
+		{
+			name: "crns ordered regardless of map iteration",
+			prev: []constants.Section{
+				func() constants.Section { s := base; s.Crn = "30003"; return s }(),
+				func() constants.Section { s := base; s.Crn = "10001"; return s }(),
+				func() constants.Section { s := base; s.Crn = "20002"; return s }(),
+			},
+			curr: []constants.Section{},
+			want: []SectionChange{
+				{Crn: "10001", Kind: SectionRemoved, Before: func() constants.Section { s := base; s.Crn = "10001"; return s }()},
+				{Crn: "20002", Kind: SectionRemoved, Before: func() constants.Section { s := base; s.Crn = "20002"; return s }()},
+				{Crn: "30003", Kind: SectionRemoved, Before: func() constants.Section { s := base; s.Crn = "30003"; return s }()},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := DiffSections(tc.prev, tc.curr)
+			if len(got) == 0 && len(tc.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("DiffSections() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiffSections_Deterministic(t *testing.T) {
+	prev := []constants.Section{
+		{Crn: "30003", AvailableSeats: "0"},
+		{Crn: "10001", AvailableSeats: "0"},
+		{Crn: "20002", AvailableSeats: "0"},
+	}
+	curr := []constants.Section{
+		{Crn: "30003", AvailableSeats: "1"},
+		{Crn: "10001", AvailableSeats: "1"},
+		{Crn: "20002", AvailableSeats: "1"},
+	}
+
+	first := DiffSections(prev, curr)
+	for i := 0; i < 10; i++ {
+		if got := DiffSections(prev, curr); !reflect.DeepEqual(got, first) {
+			t.Fatalf("DiffSections() is nondeterministic: run 0 = %+v, run %d = %+v", first, i+1, got)
+		}
+	}
+}
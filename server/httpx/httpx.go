@@ -0,0 +1,113 @@
+// Package httpx centralizes retry/backoff behavior for the outbound HTTP
+// calls this app makes, so a transient 5xx or rate limit doesn't silently
+// turn into a missed scrape. It's only safe to use for idempotent requests -
+// see SendText for why the (non-idempotent) Plivo send call doesn't go
+// through here.
+package httpx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// BodyFactory rebuilds a request body from scratch. http.Request.Body is
+// consumed by the first client.Do, so DoWithRetry needs a way to get a
+// fresh reader for every attempt rather than the original *http.Request.
+type BodyFactory func() (io.Reader, error)
+
+// Policy tunes how aggressively DoWithRetry retries a request.
+type Policy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	MaxElapsedTime  time.Duration
+}
+
+// AtlasPolicy is tuned for scraping Atlas: short and with few retries, since
+// a scrape cycle runs often enough that it's cheap to just wait for the next
+// one.
+var AtlasPolicy = Policy{
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     5 * time.Second,
+	MaxElapsedTime:  15 * time.Second,
+}
+
+// retryableStatus reports whether resp's status code should be retried.
+func retryableStatus(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// retryAfter parses a Retry-After header (seconds or HTTP-date form) off of
+// resp, returning zero if it's absent or unparseable.
+func retryAfter(resp *http.Response) time.Duration {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
+
+// DoWithRetry executes req with client, retrying on network errors, HTTP
+// 429 (honoring Retry-After), and 5xx responses with jittered exponential
+// backoff per policy. newBody is invoked before every attempt, including the
+// first, to produce a fresh, unconsumed body - pass nil for bodyless
+// requests. The request is abandoned early if ctx is cancelled.
+func DoWithRetry(ctx context.Context, client *http.Client, req *http.Request, newBody BodyFactory, policy Policy) (*http.Response, error) {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = policy.InitialInterval
+	bo.MaxInterval = policy.MaxInterval
+	bo.MaxElapsedTime = policy.MaxElapsedTime
+	withCtx := backoff.WithContext(bo, ctx)
+
+	var resp *http.Response
+	operation := func() error {
+		if newBody != nil {
+			body, err := newBody()
+			if err != nil {
+				return backoff.Permanent(err)
+			}
+			req.Body = io.NopCloser(body)
+		}
+
+		r, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if retryableStatus(r) {
+			wait := retryAfter(r)
+			r.Body.Close()
+			if wait > 0 {
+				// cenkalti/backoff/v4 has no hook to override a single
+				// attempt's delay, so honor Retry-After by waiting it out
+				// here; the policy's own backoff still applies before the
+				// attempt after that.
+				select {
+				case <-ctx.Done():
+					return backoff.Permanent(ctx.Err())
+				case <-time.After(wait):
+				}
+			}
+			return fmt.Errorf("received retryable status %d from %s", r.StatusCode, req.URL)
+		}
+
+		resp = r
+		return nil
+	}
+
+	if err := backoff.Retry(operation, withCtx); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
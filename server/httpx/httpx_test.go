@@ -0,0 +1,155 @@
+package httpx
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPolicy() Policy {
+	return Policy{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     5 * time.Millisecond,
+		MaxElapsedTime:  time.Second,
+	}
+}
+
+func TestDoWithRetry_EventualSuccess(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []int
+	}{
+		{"single 500 then success", []int{http.StatusInternalServerError, http.StatusOK}},
+		{"single 429 then success", []int{http.StatusTooManyRequests, http.StatusOK}},
+		{"mixed 500/429 then success", []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusOK}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := atomic.AddInt32(&attempts, 1) - 1
+				w.WriteHeader(tc.statuses[i])
+			}))
+			defer srv.Close()
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatalf("could not build request: %v", err)
+			}
+
+			resp, err := DoWithRetry(context.Background(), srv.Client(), req, nil, testPolicy())
+			if err != nil {
+				t.Fatalf("DoWithRetry returned error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected eventual 200, got %d", resp.StatusCode)
+			}
+			if got, want := atomic.LoadInt32(&attempts), int32(len(tc.statuses)); got != want {
+				t.Fatalf("expected %d attempts, got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestDoWithRetry_HonorsRetryAfter(t *testing.T) {
+	var attempts int32
+	var firstAttempt time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			firstAttempt = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	policy := testPolicy()
+	policy.MaxElapsedTime = 5 * time.Second
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("could not build request: %v", err)
+	}
+
+	resp, err := DoWithRetry(context.Background(), srv.Client(), req, nil, policy)
+	if err != nil {
+		t.Fatalf("DoWithRetry returned error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if elapsed := time.Since(firstAttempt); elapsed < time.Second {
+		t.Fatalf("expected DoWithRetry to wait out Retry-After, only waited %v", elapsed)
+	}
+}
+
+func TestDoWithRetry_GivesUpAfterMaxElapsedTime(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	policy := testPolicy()
+	policy.MaxElapsedTime = 50 * time.Millisecond
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("could not build request: %v", err)
+	}
+
+	if _, err := DoWithRetry(context.Background(), srv.Client(), req, nil, policy); err == nil {
+		t.Fatal("expected DoWithRetry to give up and return an error")
+	}
+	if atomic.LoadInt32(&attempts) < 2 {
+		t.Fatalf("expected more than one attempt before giving up, got %d", attempts)
+	}
+}
+
+func TestDoWithRetry_RebuildsBodyPerAttempt(t *testing.T) {
+	var attempts int32
+	var lastBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 64)
+		n, _ := r.Body.Read(buf)
+		lastBody = string(buf[:n])
+
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("could not build request: %v", err)
+	}
+
+	resp, err := DoWithRetry(context.Background(), srv.Client(), req, func() (io.Reader, error) {
+		return strings.NewReader("payload"), nil
+	}, testPolicy())
+	if err != nil {
+		t.Fatalf("DoWithRetry returned error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if atomic.LoadInt32(&attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+	if lastBody != "payload" {
+		t.Fatalf("expected the retried request to carry a fresh body, got %q", lastBody)
+	}
+}
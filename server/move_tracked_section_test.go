@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+// TestMoveTrackedSection_ConcurrentMoves fires two concurrent
+// MoveTrackedSection calls for the same CRN/term (one per tracking user) and
+// asserts both users end up on the resulting archive doc - the case the
+// read-modify-write this replaced would drop a user on. Requires the
+// Firestore emulator (FIRESTORE_EMULATOR_HOST); skipped otherwise.
+func TestMoveTrackedSection_ConcurrentMoves(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set; skipping Firestore emulator test")
+	}
+
+	ctx := context.Background()
+	fbClient, err := firestore.NewClient(ctx, "msubot-test")
+	if err != nil {
+		t.Fatalf("could not create firestore client: %v", err)
+	}
+	defer fbClient.Close()
+
+	const term = "202510"
+	const crn = "12345"
+	uids := []string{"user-a", "user-b"}
+
+	for _, uid := range uids {
+		_, err := fbClient.Collection("sections_tracked").Doc(uid).Set(ctx, map[string]interface{}{
+			"term":  term,
+			"crn":   crn,
+			"users": []string{uid},
+		})
+		if err != nil {
+			t.Fatalf("could not seed tracked doc for %s: %v", uid, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(uids))
+	for _, uid := range uids {
+		wg.Add(1)
+		go func(uid string) {
+			defer wg.Done()
+			errs <- MoveTrackedSection(ctx, fbClient, crn, uid, term)
+		}(uid)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("MoveTrackedSection returned error: %v", err)
+		}
+	}
+
+	archiveDocs, err := fbClient.Collection("sections_archive").
+		Where("term", "==", term).
+		Where("crn", "==", crn).
+		Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("could not query archive docs: %v", err)
+	}
+	if len(archiveDocs) != 1 {
+		t.Fatalf("expected exactly 1 archive doc for term/crn, got %d", len(archiveDocs))
+	}
+
+	users, ok := archiveDocs[0].Data()["users"].([]interface{})
+	if !ok {
+		t.Fatalf("archive doc users field missing or wrong type: %v", archiveDocs[0].Data())
+	}
+	if len(users) != len(uids) {
+		t.Fatalf("expected both concurrent movers to land on the archive doc, got %d users: %v", len(users), users)
+	}
+}
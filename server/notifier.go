@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/firestore"
+	log "github.com/sirupsen/logrus"
+)
+
+// Notifier delivers a SectionChange to a single tracking user. It's the
+// seam between the diffing pipeline and the delivery channel, so email or
+// push can be added later without touching how changes are detected.
+type Notifier interface {
+	Notify(ctx context.Context, change SectionChange, uid, term string) error
+}
+
+// SMSNotifier delivers SectionChanges as text messages via SendText.
+type SMSNotifier struct {
+	fbClient   *firestore.Client
+	httpClient *http.Client
+}
+
+// NewSMSNotifier builds a Notifier that texts users through Plivo.
+func NewSMSNotifier(fbClient *firestore.Client, httpClient *http.Client) *SMSNotifier {
+	return &SMSNotifier{fbClient: fbClient, httpClient: httpClient}
+}
+
+// Notify looks up uid's phone number and texts them a message describing
+// change. Change kinds with no user-facing message (e.g. SectionAdded) are
+// silently skipped. term identifies the term change.Crn belongs to, so the
+// recorded messages/{uuid} doc can be filtered/reported on by term.
+func (n *SMSNotifier) Notify(ctx context.Context, change SectionChange, uid, term string) error {
+	message := changeMessage(change)
+	if message == "" {
+		return nil
+	}
+
+	number, err := LookupUserNumber(ctx, n.fbClient, uid)
+	if err != nil {
+		return err
+	}
+
+	_, err = SendText(ctx, n.fbClient, n.httpClient, uid, change.Crn, term, number, message)
+	if err != nil {
+		log.WithContext(ctx).WithError(err).Errorf("could not notify uid %s of %s on CRN %s", uid, change.Kind, change.Crn)
+	}
+	return err
+}
+
+// changeMessage renders a SectionChange as SMS body text, or "" for change
+// kinds that aren't worth texting a user about.
+func changeMessage(change SectionChange) string {
+	section := change.After
+	switch change.Kind {
+	case SeatsOpened:
+		return fmt.Sprintf("A seat opened up in %s %s-%s (CRN %s)!", section.DeptAbbr, section.CourseNumber, section.SectionNumber, section.Crn)
+	case InstructorChanged:
+		return fmt.Sprintf("The instructor for %s %s-%s (CRN %s) changed to %s.", section.DeptAbbr, section.CourseNumber, section.SectionNumber, section.Crn, section.Instructor)
+	case TimeChanged:
+		return fmt.Sprintf("The meeting time for %s %s-%s (CRN %s) changed to %s.", section.DeptAbbr, section.CourseNumber, section.SectionNumber, section.Crn, section.Time)
+	case LocationChanged:
+		return fmt.Sprintf("The location for %s %s-%s (CRN %s) changed to %s.", section.DeptAbbr, section.CourseNumber, section.SectionNumber, section.Crn, section.Location)
+	case SectionRemoved:
+		before := change.Before
+		return fmt.Sprintf("%s %s-%s (CRN %s), which you were tracking, has been removed or cancelled.", before.DeptAbbr, before.CourseNumber, before.SectionNumber, before.Crn)
+	default:
+		return ""
+	}
+}
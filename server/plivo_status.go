@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	log "github.com/sirupsen/logrus"
+)
+
+// plivoStatusCallbackPath is where PlivoStatusHandler is mounted. SendText
+// points Plivo at this path (rooted at APP_BASE_URL) so delivery updates
+// land back here.
+const plivoStatusCallbackPath = "/plivo/status"
+
+// PlivoStatusHandler receives Plivo's delivery-status callbacks and upserts
+// the status, error code, and delivery time onto the matching messages/{uuid}
+// doc. Every request is verified against X-Plivo-Signature-V3 before it's
+// trusted.
+func PlivoStatusHandler(fbClient *firestore.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if err := r.ParseForm(); err != nil {
+			log.WithContext(ctx).WithError(err).Errorf("Could not parse Plivo status callback form")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !verifyPlivoSignatureV3(r) {
+			log.WithContext(ctx).Errorf("Plivo status callback failed signature verification")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		messageUUID := r.PostForm.Get("MessageUUID")
+		if messageUUID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		update := map[string]interface{}{
+			"status": r.PostForm.Get("Status"),
+		}
+		if errorCode := r.PostForm.Get("ErrorCode"); errorCode != "" {
+			update["error_code"] = errorCode
+		}
+		if r.PostForm.Get("Status") == "delivered" {
+			update["delivered_at"] = time.Now()
+		}
+
+		_, err := fbClient.Collection("messages").Doc(messageUUID).Set(ctx, update, firestore.MergeAll)
+		if err != nil {
+			log.WithContext(ctx).WithError(err).Errorf("Could not update message %s from status callback", messageUUID)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// verifyPlivoSignatureV3 recomputes the HMAC-SHA256 signature Plivo sends in
+// X-Plivo-Signature-V3: the full callback URL concatenated with the nonce,
+// keyed by PLIVO_AUTH_TOKEN. Unlike V2, V3 does not fold the POSTed form
+// params into the signed payload. See
+// https://www.plivo.com/docs/sms/concepts/signature-v3-validation/.
+func verifyPlivoSignatureV3(r *http.Request) bool {
+	authToken := os.Getenv("PLIVO_AUTH_TOKEN")
+	if authToken == "" {
+		log.Errorf("Environment is missing required variable PLIVO_AUTH_TOKEN")
+		return false
+	}
+
+	nonce := r.Header.Get("X-Plivo-Signature-V3-Nonce")
+	signature := r.Header.Get("X-Plivo-Signature-V3")
+	if nonce == "" || signature == "" {
+		return false
+	}
+
+	payload := plivoStatusCallbackURL() + nonce
+
+	mac := hmac.New(sha256.New, []byte(authToken))
+	mac.Write([]byte(payload))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// MessageDeliveryStats is the per-user delivery summary used to surface
+// silently-failing notifications (carrier blocks, bad numbers, etc.).
+type MessageDeliveryStats struct {
+	Uid            string
+	TotalSent      int
+	TotalDelivered int
+	TotalFailed    int
+	SuccessRate    float64
+}
+
+// QueryUserDeliveryStats computes a user's message delivery success rate
+// from their messages/{uuid} docs, for the admin messages subcommand.
+func QueryUserDeliveryStats(ctx context.Context, fbClient *firestore.Client, uid string) (MessageDeliveryStats, error) {
+	stats := MessageDeliveryStats{Uid: uid}
+
+	docs, err := fbClient.Collection("messages").Where("uid", "==", uid).Documents(ctx).GetAll()
+	if err != nil {
+		log.WithContext(ctx).WithError(err).Errorf("Could not query messages for uid %s", uid)
+		return stats, err
+	}
+
+	for _, doc := range docs {
+		stats.TotalSent++
+		switch doc.Data()["status"] {
+		case "delivered":
+			stats.TotalDelivered++
+		case "failed", "undelivered":
+			stats.TotalFailed++
+		}
+	}
+
+	if stats.TotalSent > 0 {
+		stats.SuccessRate = float64(stats.TotalDelivered) / float64(stats.TotalSent)
+	}
+
+	return stats, nil
+}
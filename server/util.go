@@ -5,37 +5,40 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/SpencerCornish/msubot-appspot/server/constants"
+	"github.com/SpencerCornish/msubot-appspot/server/httpx"
 
 	"cloud.google.com/go/firestore"
 	"github.com/PuerkitoBio/goquery"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-// MakeAtlasSectionRequest makes a request to Atlas for section data in the term, department, and course
-func MakeAtlasSectionRequest(client *http.Client, term, dept, course string) (*http.Response, error) {
+// MakeAtlasSectionRequest makes a request to Atlas for section data in the term, department, and course.
+// Transient network errors and 5xx responses are retried with a short backoff tuned for scraping.
+func MakeAtlasSectionRequest(ctx context.Context, client *http.Client, term, dept, course string) (*http.Response, error) {
 	body := fmt.Sprintf(constants.AtlasPostFormatString,
 		term,
 		dept,
 		course)
 
 	req, err := http.NewRequest("POST", constants.AtlasSectionURL, strings.NewReader(body))
-	defer req.Body.Close()
 	if err != nil {
 		return nil, err
 	}
-
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	return resp, nil
+
+	return httpx.DoWithRetry(ctx, client, req, func() (io.Reader, error) {
+		return strings.NewReader(body), nil
+	}, httpx.AtlasPolicy)
 }
 
 // ParseSectionResponse turns the http.Response into a slice of sections
@@ -99,36 +102,123 @@ func ParseSectionResponse(response *http.Response, crnToFind string) ([]constant
 // Phone Functions
 ////////////////////////////
 
-// SendText sends a text message to the specified phone number
-func SendText(client *http.Client, number, message string) (response *http.Response, err error) {
+// plivoSendRequest is the outbound send payload. It mirrors
+// constants.PlivoRequest plus the status callback URL, which Plivo POSTs
+// delivery updates back to.
+type plivoSendRequest struct {
+	Src  string `json:"src"`
+	Dst  string `json:"dst"`
+	Text string `json:"text"`
+	URL  string `json:"url,omitempty"`
+}
+
+// plivoSendResponse is the subset of Plivo's send response we care about.
+type plivoSendResponse struct {
+	MessageUUID []string `json:"message_uuid"`
+	APIID       string   `json:"api_id"`
+}
+
+// SendText sends a text message to the specified phone number, registers a
+// delivery-status callback with Plivo, and records the outbound message as
+// messages/{uuid} so its delivery status can be tracked. uid, crn, and term
+// identify what the text was about. Returns the Plivo message UUID.
+//
+// Unlike MakeAtlasSectionRequest, this call is not retried: sending a text
+// isn't idempotent and Plivo isn't sent an idempotency key, so retrying a
+// send that failed after Plivo already queued it (a 5xx or timeout on our
+// end doesn't mean Plivo didn't act on the request) risks double-texting a
+// user.
+func SendText(ctx context.Context, fbClient *firestore.Client, client *http.Client, uid, crn, term, number, message string) (string, error) {
 	authID := os.Getenv("PLIVO_AUTH_ID")
 	authToken := os.Getenv("PLIVO_AUTH_TOKEN")
 	if authID == "" || authToken == "" {
 		log.Errorf("Environment is missing required variables PLIVO_AUTH_ID and PLIVO_AUTH_TOKEN")
-		return nil, err
+		return "", fmt.Errorf("environment is missing required variables PLIVO_AUTH_ID and PLIVO_AUTH_TOKEN")
+	}
+
+	reqURL := fmt.Sprintf(constants.PlivoAPIEndpoint, authID)
+	data := plivoSendRequest{
+		Src:  constants.PlivoSrcNum,
+		Dst:  number,
+		Text: message,
+		URL:  plivoStatusCallbackURL(),
 	}
-	// TODO: Create sms callback handler
-	url := fmt.Sprintf(constants.PlivoAPIEndpoint, authID)
-	data := constants.PlivoRequest{Src: constants.PlivoSrcNum, Dst: number, Text: message}
 
 	js, err := json.Marshal(data)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(js))
+	request, err := http.NewRequest("POST", reqURL, bytes.NewBuffer(js))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	request.SetBasicAuth(authID, authToken)
 	request.Header.Add("Content-Type", "application/json")
 	resp, err := client.Do(request)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var parsed plivoSendResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		log.WithContext(ctx).WithError(err).Errorf("Could not parse Plivo send response")
+		return "", err
+	}
+	if len(parsed.MessageUUID) == 0 {
+		return "", fmt.Errorf("Plivo response did not include a message_uuid")
 	}
-	resp.Body.Close()
-	return resp, err
+	messageUUID := parsed.MessageUUID[0]
+
+	if fbClient != nil {
+		if err := recordOutboundMessage(ctx, fbClient, messageUUID, uid, crn, term); err != nil {
+			log.WithContext(ctx).WithError(err).Errorf("Could not record outbound message %s", messageUUID)
+		}
+	}
+
+	return messageUUID, nil
+}
+
+// recordOutboundMessage writes the messages/{uuid} doc for a just-sent
+// text. PlivoStatusHandler's delivery-status callback can race ahead of
+// this write (SendText only records the message after the send call
+// returns, and Plivo can call back before then), so this only sets "status" if the doc
+// doesn't already exist - merging uid/crn/term/sent_at onto an existing doc
+// without reverting whatever status the callback already recorded.
+func recordOutboundMessage(ctx context.Context, fbClient *firestore.Client, messageUUID, uid, crn, term string) error {
+	ref := fbClient.Collection("messages").Doc(messageUUID)
+
+	return fbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		fields := map[string]interface{}{
+			"uid":     uid,
+			"crn":     crn,
+			"term":    term,
+			"sent_at": time.Now(),
+		}
+
+		_, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			fields["status"] = "queued"
+			return tx.Create(ref, fields)
+		}
+		if err != nil {
+			return err
+		}
+
+		return tx.Set(ref, fields, firestore.MergeAll)
+	})
+}
+
+// plivoStatusCallbackURL builds the URL Plivo should POST delivery status
+// updates to, rooted at this app's public base URL.
+func plivoStatusCallbackURL() string {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		return ""
+	}
+	return strings.TrimRight(base, "/") + plivoStatusCallbackPath
 }
 
 // FetchUserDataWithNumber check firebase to see if the user exists in our database. Returns userData map and userID
@@ -179,77 +269,69 @@ func GetFirebaseClient(ctx context.Context) (*firestore.Client, error) {
 	return fbClient, nil
 }
 
-// MoveTrackedSection moves old sections out of the prod area
+// MoveTrackedSection moves old sections out of the prod area. The archive
+// lookup, tracked-doc read, user merge, and tracked-doc delete all happen
+// inside a single Firestore transaction so two concurrent moves for the
+// same CRN can't race each other into dropping a user off the archive doc.
 func MoveTrackedSection(ctx context.Context, fbClient *firestore.Client, crn, uid, term string) error {
+	trackedRef := fbClient.Collection("sections_tracked").Doc(uid)
 
-	// Look for an existing archive doc to add userdata to
-	docArchiveIter := fbClient.Collection("sections_archive").Where("term", "==", term).Where("crn", "==", crn).Documents(ctx)
-	archiveDocs, err := docArchiveIter.GetAll()
-
-	if err != nil {
-		log.WithContext(ctx).WithError(err).Errorf("Could not get list of archive docs for uid %v: %v", uid, err)
-		return err
-	}
-
-	// Get the document that we need to move
-	docToMove, err := fbClient.Collection("sections_tracked").Doc(uid).Get(ctx)
-	docToMoveData := docToMove.Data()
-
-	if err != nil {
-		log.WithContext(ctx).WithError(err).Errorf("Could not get the new doc for uid %s : %v", uid, err)
-		return err
-	}
-
-	//  if there is a doc, merge with it rather than making a new one
-	if archiveDocs != nil || len(archiveDocs) > 0 {
-		if len(archiveDocs) > 1 {
-			log.WithContext(ctx).Warningf("Duplicate archiveDocs: %v", archiveDocs)
+	err := fbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Look for an existing archive doc to add userdata to
+		archiveDocs, err := tx.Documents(
+			fbClient.Collection("sections_archive").Where("term", "==", term).Where("crn", "==", crn),
+		).GetAll()
+		if err != nil {
+			log.WithContext(ctx).WithError(err).Errorf("Could not get list of archive docs for uid %v: %v", uid, err)
+			return err
 		}
 
-		//  Get the data for the archive docs
-		data := archiveDocs[0].Data()
-
-		// get all the users
-		users, ok := data["users"].([]interface{})
-		if !ok {
-			log.WithContext(ctx).Errorf("couldn't parse all userdata")
-			return fmt.Errorf("Couldn't parse all userdata")
+		// Get the document that we need to move
+		docToMove, err := tx.Get(trackedRef)
+		if err != nil {
+			log.WithContext(ctx).WithError(err).Errorf("Could not get the new doc for uid %s : %v", uid, err)
+			return err
 		}
+		docToMoveData := docToMove.Data()
 
-		// get all the users
 		usersToAdd, ok := docToMoveData["users"].([]interface{})
 		if !ok {
-			log.WithContext(ctx).WithError(err).Errorf("couldn't parse userslice")
+			log.WithContext(ctx).Errorf("couldn't parse userslice")
 			return fmt.Errorf("couldn't parse userslice")
 		}
 
-		//  make a mega list
-		allUsers := append(users, usersToAdd...)
+		//  if there is a doc, merge with it rather than making a new one
+		if len(archiveDocs) > 0 {
+			if len(archiveDocs) > 1 {
+				log.WithContext(ctx).Warningf("Duplicate archiveDocs: %v", archiveDocs)
+			}
 
-		// Update that userlist
-		_, err := archiveDocs[0].Ref.Set(ctx, map[string]interface{}{
-			"users": allUsers,
-		}, firestore.MergeAll)
-		if err != nil {
-			log.WithContext(ctx).WithError(err).Errorf("Error appending users to archive")
-			return fmt.Errorf("Error appending users to archive")
+			// Union the users in instead of reading-then-writing the full
+			// list, so a concurrent move against the same archive doc can't
+			// stomp on this one's additions.
+			err = tx.Set(archiveDocs[0].Ref, map[string]interface{}{
+				"users": firestore.ArrayUnion(usersToAdd...),
+			}, firestore.MergeAll)
+			if err != nil {
+				log.WithContext(ctx).WithError(err).Errorf("Error appending users to archive")
+				return fmt.Errorf("Error appending users to archive")
+			}
+		} else {
+			// Add a new doc
+			newArchiveRef := fbClient.Collection("sections_archive").NewDoc()
+			if err := tx.Create(newArchiveRef, docToMoveData); err != nil {
+				log.WithContext(ctx).WithError(err).Errorf("Error creating a new archived doc")
+				return err
+			}
 		}
-	} else {
 
-		// Add a new doc
-		_, _, err := fbClient.Collection("sections_archive").Add(ctx, docToMoveData)
-		if err != nil {
-			log.WithContext(ctx).WithError(err).Errorf("Error creating a new archived doc")
+		//  Finally delete the old one
+		if err := tx.Delete(trackedRef); err != nil {
+			log.WithContext(ctx).WithError(err).Errorf("Error deleting old document")
 			return err
 		}
+		return nil
+	})
 
-	}
-
-	//  Finally delete the old one
-	_, err = docToMove.Ref.Delete(ctx)
-	if err != nil {
-		log.WithContext(ctx).WithError(err).Errorf("Error deleting old document")
-		return err
-	}
-	return nil
+	return err
 }
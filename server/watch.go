@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SpencerCornish/msubot-appspot/server/constants"
+
+	"cloud.google.com/go/firestore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// coalesceInterval is how often the index is drained into Atlas requests.
+// Firestore snapshot events land as fast as users add/remove trackers, but
+// there's no reason to hit Atlas more than this often for the same course.
+const coalesceInterval = 15 * time.Second
+
+var (
+	snapshotEventsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "msubot_watch_snapshot_events_total",
+		Help: "Firestore snapshot events received on sections_tracked.",
+	})
+	atlasFetchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "msubot_watch_atlas_fetches_total",
+		Help: "Atlas section requests issued by the tracked-section watcher.",
+	})
+	notificationsSentTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "msubot_watch_notifications_sent_total",
+		Help: "Notifier calls that returned without error for a tracked-section change, one per tracking user; includes change kinds the notifier skips without sending.",
+	})
+)
+
+// courseKey groups tracked docs by the Atlas request they share, so we fetch
+// a course once instead of once per tracked CRN.
+type courseKey struct {
+	term, dept, course string
+}
+
+// trackedDoc is a decoded "sections_tracked" document.
+type trackedDoc struct {
+	Term        string            `firestore:"term"`
+	Dept        string            `firestore:"dept"`
+	Course      string            `firestore:"course"`
+	Crn         string            `firestore:"crn"`
+	Users       []string          `firestore:"users"`
+	LastSection constants.Section `firestore:"lastSection"`
+
+	ref *firestore.DocumentRef
+}
+
+// trackedIndex is the in-memory {term, dept, course} -> tracked docs index
+// kept current by the Firestore snapshot listener. It's read and rebuilt
+// entirely on every snapshot, so a mutex is enough - there's no need for
+// finer-grained locking at the document count this module deals with.
+type trackedIndex struct {
+	mu   sync.RWMutex
+	docs map[courseKey][]trackedDoc
+}
+
+func newTrackedIndex() *trackedIndex {
+	return &trackedIndex{docs: map[courseKey][]trackedDoc{}}
+}
+
+func (t *trackedIndex) replace(docs map[courseKey][]trackedDoc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.docs = docs
+}
+
+func (t *trackedIndex) snapshot() map[courseKey][]trackedDoc {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := make(map[courseKey][]trackedDoc, len(t.docs))
+	for k, v := range t.docs {
+		out[k] = v
+	}
+	return out
+}
+
+// WatchTrackedSections opens a Firestore snapshot listener on
+// sections_tracked and keeps an in-memory index of tracked courses up to
+// date in real time. A coalesced ticker drains that index into one
+// MakeAtlasSectionRequest per unique {term, dept, course}, replacing the
+// old per-CRN cron scrape, diffs the result against each tracked doc's last
+// known state, and routes every SectionChange through notifier. It blocks
+// until ctx is cancelled, reconnecting the listener with exponential backoff
+// if the stream errors out.
+func WatchTrackedSections(ctx context.Context, fbClient *firestore.Client, httpClient *http.Client, notifier Notifier) {
+	index := newTrackedIndex()
+
+	go runSnapshotListener(ctx, fbClient, index)
+
+	ticker := time.NewTicker(coalesceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pollTrackedCourses(ctx, fbClient, notifier, httpClient, index.snapshot())
+		}
+	}
+}
+
+// runSnapshotListener keeps the tracked-course index in sync with
+// sections_tracked, reconnecting with exponential backoff when the stream
+// errors - Firestore snapshot iterators don't survive context-less network
+// blips on their own.
+func runSnapshotListener(ctx context.Context, fbClient *firestore.Client, index *trackedIndex) {
+	backoff := time.Second
+	const maxBackoff = 30 * time.Second
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		err := watchOnce(ctx, fbClient, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.WithContext(ctx).WithError(err).Errorf("sections_tracked snapshot listener failed, reconnecting in %v", backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// watchOnce runs a single snapshot iterator to completion, rebuilding the
+// index on every batch of changes. It returns when the iterator errors or
+// ctx is cancelled. The caller's reconnect backoff is never reset, so after
+// repeated failures it stays at its cap.
+func watchOnce(ctx context.Context, fbClient *firestore.Client, index *trackedIndex) error {
+	it := fbClient.Collection("sections_tracked").Snapshots(ctx)
+	defer it.Stop()
+
+	for {
+		snap, err := it.Next()
+		if status.Code(err) == codes.Canceled {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		snapshotEventsTotal.Inc()
+
+		docs := map[courseKey][]trackedDoc{}
+		for _, doc := range snap.Documents {
+			var td trackedDoc
+			if err := doc.DataTo(&td); err != nil {
+				log.WithContext(ctx).WithError(err).Errorf("could not decode tracked doc %s", doc.Ref.ID)
+				continue
+			}
+			td.ref = doc.Ref
+			key := courseKey{term: td.Term, dept: td.Dept, course: td.Course}
+			docs[key] = append(docs[key], td)
+		}
+
+		index.replace(docs)
+	}
+}
+
+// pollTrackedCourses issues one Atlas request per unique {term, dept,
+// course} group in the index and diffs the tracked CRNs' last-seen state
+// against the full current course roster, so a tracked CRN that Atlas drops
+// or that gets replaced by a new one is actually visible to DiffSections
+// instead of being compared against itself.
+func pollTrackedCourses(ctx context.Context, fbClient *firestore.Client, notifier Notifier, httpClient *http.Client, docs map[courseKey][]trackedDoc) {
+	for key, tracked := range docs {
+		atlasFetchesTotal.Inc()
+
+		resp, err := MakeAtlasSectionRequest(ctx, httpClient, key.term, key.dept, key.course)
+		if err != nil {
+			log.WithContext(ctx).WithError(err).Errorf("could not fetch Atlas sections for %+v", key)
+			continue
+		}
+
+		sections, err := ParseSectionResponse(resp, "")
+		resp.Body.Close()
+		if err != nil {
+			log.WithContext(ctx).WithError(err).Errorf("could not parse Atlas sections for %+v", key)
+			continue
+		}
+
+		byCrn := make(map[string]constants.Section, len(sections))
+		for _, s := range sections {
+			byCrn[s.Crn] = s
+		}
+
+		prevSections := make([]constants.Section, 0, len(tracked))
+		trackedByCrn := make(map[string][]trackedDoc, len(tracked))
+		for _, td := range tracked {
+			if td.LastSection.Crn != "" {
+				prevSections = append(prevSections, td.LastSection)
+			}
+			trackedByCrn[td.Crn] = append(trackedByCrn[td.Crn], td)
+		}
+
+		removedCrns := map[string]bool{}
+		for _, change := range DiffSections(prevSections, sections) {
+			for _, td := range trackedByCrn[change.Crn] {
+				notifyTrackedUsers(ctx, notifier, td, change)
+			}
+			if change.Kind == SectionRemoved {
+				removedCrns[change.Crn] = true
+			}
+		}
+
+		for _, td := range tracked {
+			section, ok := byCrn[td.Crn]
+			if !ok {
+				// td.Crn is gone from Atlas and DiffSections just fired
+				// SectionRemoved for it. Archive and delete the tracked
+				// doc so it drops out of the index - otherwise it stays
+				// at its stale LastSection forever and re-fires
+				// SectionRemoved (and re-texts every tracking user) on
+				// every future tick.
+				if removedCrns[td.Crn] {
+					archiveRemovedTrackedDoc(ctx, fbClient, td)
+				}
+				continue
+			}
+			persistLastSection(ctx, td, section)
+		}
+	}
+}
+
+// notifyTrackedUsers routes change through notifier for every user tracking
+// td's CRN.
+func notifyTrackedUsers(ctx context.Context, notifier Notifier, td trackedDoc, change SectionChange) {
+	for _, uid := range td.Users {
+		if err := notifier.Notify(ctx, change, uid, td.Term); err != nil {
+			continue
+		}
+		notificationsSentTotal.Inc()
+	}
+}
+
+// persistLastSection records section as td's new lastSection, so the next
+// poll has something to diff against.
+func persistLastSection(ctx context.Context, td trackedDoc, section constants.Section) {
+	if _, err := td.ref.Set(ctx, map[string]interface{}{
+		"lastSection": section,
+	}, firestore.MergeAll); err != nil {
+		log.WithContext(ctx).WithError(err).Errorf("could not persist lastSection for CRN %s", section.Crn)
+	}
+}
+
+// archiveRemovedTrackedDoc moves a tracked doc whose CRN Atlas no longer
+// returns into sections_archive - merging into an existing archive doc for
+// the same term/crn the same way MoveTrackedSection does, or creating one -
+// then deletes it from sections_tracked. This is what makes a cancelled
+// section drop out of the index instead of being re-diffed against the
+// same stale LastSection (and re-texting every tracking user) on every
+// future poll.
+func archiveRemovedTrackedDoc(ctx context.Context, fbClient *firestore.Client, td trackedDoc) {
+	err := fbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		archiveDocs, err := tx.Documents(
+			fbClient.Collection("sections_archive").Where("term", "==", td.Term).Where("crn", "==", td.Crn),
+		).GetAll()
+		if err != nil {
+			return err
+		}
+
+		if len(archiveDocs) > 0 {
+			users := make([]interface{}, len(td.Users))
+			for i, u := range td.Users {
+				users[i] = u
+			}
+			if err := tx.Set(archiveDocs[0].Ref, map[string]interface{}{
+				"users": firestore.ArrayUnion(users...),
+			}, firestore.MergeAll); err != nil {
+				return err
+			}
+		} else {
+			newArchiveRef := fbClient.Collection("sections_archive").NewDoc()
+			if err := tx.Create(newArchiveRef, map[string]interface{}{
+				"term":   td.Term,
+				"dept":   td.Dept,
+				"course": td.Course,
+				"crn":    td.Crn,
+				"users":  td.Users,
+			}); err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(td.ref)
+	})
+	if err != nil {
+		log.WithContext(ctx).WithError(err).Errorf("could not archive removed tracked doc for CRN %s", td.Crn)
+	}
+}